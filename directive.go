@@ -0,0 +1,151 @@
+// Copyright (C) 2024 BadAimWeeb
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uwsgi
+
+import (
+	"encoding/json"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func init() {
+	httpcaddyfile.RegisterDirective("uwsgi", parseUwsgi)
+	httpcaddyfile.RegisterDirectiveOrder("uwsgi", httpcaddyfile.Before, "file_server")
+}
+
+// parseUwsgi is a convenience directive that expands
+//
+//	uwsgi <upstreams...> {
+//		<uwsgi transport options...>
+//	}
+//
+// into the equivalent
+//
+//	reverse_proxy <upstreams...> {
+//		transport uwsgi {
+//			<uwsgi transport options...>
+//		}
+//	}
+//
+// An optional "root" subdirective opts into a minimal static-asset preset, in the spirit of
+// php_fastcgi's try_files handling, but much simpler: most WSGI/PSGI/Rack frameworks do their
+// own routing and don't need php_fastcgi's index-file rewriting, so all this preset does is let
+// requests for a file that exists under root be served directly by file_server instead of being
+// proxied.
+//
+//	uwsgi <upstreams...> {
+//		root <path>
+//		<uwsgi transport options...>
+//	}
+//
+// is equivalent to
+//
+//	route {
+//		file_server {
+//			root <path>
+//		}
+//		reverse_proxy <upstreams...> {
+//			transport uwsgi {
+//				<uwsgi transport options...>
+//			}
+//		}
+//	}
+//
+// where the file_server only handles requests matching an existing file under root, and
+// everything else falls through to the uwsgi upstream. Without "root", every request is
+// proxied, same as before.
+func parseUwsgi(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	if !h.Next() {
+		return nil, h.ArgErr()
+	}
+
+	userMatcherSet, err := h.ExtractMatcherSet()
+	if err != nil {
+		return nil, err
+	}
+
+	args := h.RemainingArgs()
+	if len(args) == 0 {
+		return nil, h.ArgErr()
+	}
+
+	transport := &Transport{UWSGIParams: make(map[string]string)}
+	root := ""
+	for h.NextBlock(0) {
+		if h.Val() == "root" {
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			root = h.Val()
+			continue
+		}
+		if err := transport.unmarshalSubdirective(h.Dispenser); err != nil {
+			return nil, err
+		}
+	}
+
+	upstreams := make([]*reverseproxy.Upstream, 0, len(args))
+	for _, addr := range args {
+		upstreams = append(upstreams, &reverseproxy.Upstream{Dial: addr})
+	}
+
+	rpHandler := &reverseproxy.Handler{
+		TransportRaw: caddyconfig.JSONModuleObject(transport, "protocol", "uwsgi", nil),
+		Upstreams:    upstreams,
+	}
+	rpRoute := caddyhttp.Route{
+		HandlersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(rpHandler, "handler", "reverse_proxy", nil)},
+	}
+
+	routes := caddyhttp.RouteList{}
+	if root != "" {
+		staticMatcherSet := caddy.ModuleMap{
+			"file": h.JSON(fileserver.MatchFile{Root: root}),
+		}
+		routes = append(routes, caddyhttp.Route{
+			MatcherSetsRaw: []caddy.ModuleMap{staticMatcherSet},
+			HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(fileserver.FileServer{Root: root}, "handler", "file_server", nil)},
+		})
+	}
+	routes = append(routes, rpRoute)
+
+	subroute := caddyhttp.Subroute{Routes: routes}
+
+	// the user's matcher is a prerequisite for ours, so wrap ours in a subroute and return
+	// that, same as php_fastcgi does
+	if userMatcherSet != nil {
+		return []httpcaddyfile.ConfigValue{
+			{
+				Class: "route",
+				Value: caddyhttp.Route{
+					MatcherSetsRaw: []caddy.ModuleMap{userMatcherSet},
+					HandlersRaw:    []json.RawMessage{caddyconfig.JSONModuleObject(subroute, "handler", "subroute", nil)},
+				},
+			},
+		}, nil
+	}
+
+	return []httpcaddyfile.ConfigValue{
+		{
+			Class: "route",
+			Value: subroute,
+		},
+	}, nil
+}
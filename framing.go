@@ -0,0 +1,64 @@
+// Copyright (C) 2024 BadAimWeeb
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uwsgi
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// maxPacketSize is the largest datasize a single uwsgi packet header can address, since
+// datasize is transmitted as a little-endian uint16. The uwsgi wire protocol has no continuation
+// convention between packets - each header+body is a complete request as far as the backend is
+// concerned - so a vars body that doesn't fit in one packet can't be split; it must be rejected.
+const maxPacketSize = 65535
+
+// writeVarsPacket writes the block vars body to conn as a single uwsgi packet. It returns an
+// error instead of writing anything if body is too large to fit in one packet's uint16 datasize.
+func writeVarsPacket(conn net.Conn, modifier1, modifier2 byte, body *bytes.Buffer) error {
+	if body.Len() > maxPacketSize {
+		return fmt.Errorf("uwsgi vars packet of %d bytes exceeds the %d-byte maximum", body.Len(), maxPacketSize)
+	}
+
+	if err := writePacketHeader(conn, modifier1, modifier2, body.Len()); err != nil {
+		return err
+	}
+	_, err := conn.Write(body.Bytes())
+	return err
+}
+
+func writePacketHeader(conn net.Conn, modifier1, modifier2 byte, datasize int) error {
+	header := [4]byte{modifier1, byte(datasize), byte(datasize >> 8), modifier2}
+	_, err := conn.Write(header[:])
+	return err
+}
+
+// halfCloseWriter is implemented by connection types (TCP, unix) that support shutting down
+// only the write half, letting the peer see EOF without tearing down the whole connection.
+type halfCloseWriter interface {
+	CloseWrite() error
+}
+
+// halfCloseWrite signals EOF to the uWSGI backend on the write side of conn, which is needed
+// so it knows the request body is complete when its length wasn't known up front (e.g.
+// chunked request bodies, where CONTENT_LENGTH can't be trusted). Connections shut down this
+// way can no longer be reused, since they can never be written to again.
+func halfCloseWrite(conn net.Conn) error {
+	if hc, ok := conn.(halfCloseWriter); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
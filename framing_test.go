@@ -0,0 +1,77 @@
+// Copyright (C) 2024 BadAimWeeb
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uwsgi
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestWriteVarsPacketHeader(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	body := bytes.NewBufferString("hello")
+	errCh := make(chan error, 1)
+	go func() { errCh <- writeVarsPacket(client, 0, 0, body) }()
+
+	buf := make([]byte, 4+5)
+	if _, err := readFull(server, buf); err != nil {
+		t.Fatalf("reading packet: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("writeVarsPacket returned error: %v", err)
+	}
+
+	if buf[0] != 0 || buf[3] != 0 {
+		t.Fatalf("unexpected modifier bytes: %v", buf[:4])
+	}
+	gotSize := int(buf[1]) | int(buf[2])<<8
+	if gotSize != 5 {
+		t.Fatalf("datasize = %d, want 5", gotSize)
+	}
+	if string(buf[4:]) != "hello" {
+		t.Fatalf("body = %q, want %q", buf[4:], "hello")
+	}
+}
+
+func TestWriteVarsPacketRejectsOversizedBody(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	body := bytes.NewBuffer(make([]byte, maxPacketSize+1))
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- writeVarsPacket(client, 0, 0, body) }()
+
+	if err := <-errCh; err == nil {
+		t.Fatal("writeVarsPacket should have returned an error for an oversized body")
+	}
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	read := 0
+	for read < len(buf) {
+		n, err := conn.Read(buf[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2024 BadAimWeeb
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uwsgi
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// connPool keeps a small set of idle connections around per upstream (keyed by
+// network+address) so RoundTrip doesn't have to pay for a fresh net.Dial (and TCP
+// handshake) on every request.
+type connPool struct {
+	maxConns    int
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*pooledConn
+}
+
+type pooledConn struct {
+	net.Conn
+	freedAt time.Time
+}
+
+func newConnPool(maxConns int, idleTimeout time.Duration) *connPool {
+	return &connPool{
+		maxConns:    maxConns,
+		idleTimeout: idleTimeout,
+		idle:        make(map[string][]*pooledConn),
+	}
+}
+
+// get returns a pooled connection for network/address if one is available and hasn't
+// gone stale, otherwise it dials a new one. If tlsConfig is non-nil, new connections are
+// established with tls.Dial instead of a plain net.Dial.
+func (p *connPool) get(network, address string, dialTimeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	key := network + "/" + address
+
+	p.mu.Lock()
+	conns := p.idle[key]
+	for len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		p.idle[key] = conns
+		if p.idleTimeout > 0 && time.Since(pc.freedAt) > p.idleTimeout {
+			pc.Conn.Close()
+			continue
+		}
+		p.mu.Unlock()
+		return pc.Conn, nil
+	}
+	p.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	if tlsConfig != nil {
+		return tls.DialWithDialer(&dialer, network, address, tlsConfig)
+	}
+	return dialer.Dial(network, address)
+}
+
+// put returns a connection to the pool for reuse, closing it instead if the pool for
+// that upstream is already full.
+func (p *connPool) put(network, address string, conn net.Conn) {
+	key := network + "/" + address
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[key]) >= p.maxConns {
+		conn.Close()
+		return
+	}
+	p.idle[key] = append(p.idle[key], &pooledConn{Conn: conn, freedAt: time.Now()})
+}
+
+// closeAll closes every idle connection held by the pool.
+func (p *connPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, conns := range p.idle {
+		for _, pc := range conns {
+			pc.Conn.Close()
+		}
+		delete(p.idle, key)
+	}
+}
+
+// wrapBody wraps body so that closing it disposes of conn once the caller is done reading the
+// response. When reusable is true, closing it returns conn to the pool for the next request to
+// the same upstream; when false (e.g. after a half-closed write side), conn is closed outright
+// since it can no longer be written to.
+func (p *connPool) wrapBody(network, address string, conn net.Conn, body io.ReadCloser, reusable bool) io.ReadCloser {
+	return &pooledBody{ReadCloser: body, pool: p, network: network, address: address, conn: conn, reusable: reusable}
+}
+
+type pooledBody struct {
+	io.ReadCloser
+	pool     *connPool
+	network  string
+	address  string
+	conn     net.Conn
+	reusable bool
+
+	closed bool
+}
+
+func (b *pooledBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	// The caller may close us before reading the body to completion (a disconnected
+	// client, a write error, a timeout). If we're about to hand conn back to the pool,
+	// whatever's left of this response has to be drained first, or the next request to
+	// reuse conn will start reading mid-response instead of at the next response's
+	// headers.
+	var drainErr error
+	if b.reusable {
+		_, drainErr = io.Copy(io.Discard, b.ReadCloser)
+	}
+
+	err := b.ReadCloser.Close()
+	if err == nil {
+		err = drainErr
+	}
+	if err != nil || !b.reusable {
+		b.conn.Close()
+		return err
+	}
+
+	b.conn.SetDeadline(time.Time{})
+	b.pool.put(b.network, b.address, b.conn)
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2024 BadAimWeeb
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uwsgi
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestConnPoolGetAbstractUnixSocket verifies that dialing a Linux abstract socket address
+// (leading "@") reaches the listener unmodified, i.e. the pool doesn't rewrite it to a
+// NUL-prefixed form before handing it to net.Dial - that rewrite would double up the kernel's
+// own "@" handling and produce a sockaddr that doesn't match any listener.
+func TestConnPoolGetAbstractUnixSocket(t *testing.T) {
+	addr := "@caddy-uwsgi-transport-test-" + t.Name()
+
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Skipf("abstract unix sockets not supported on this platform: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	p := newConnPool(8, time.Minute)
+	conn, err := p.get("unix", addr, time.Second, nil)
+	if err != nil {
+		t.Fatalf("get() failed to dial abstract socket: %v", err)
+	}
+	conn.Close()
+
+	if err := <-accepted; err != nil {
+		t.Fatalf("listener failed to accept: %v", err)
+	}
+}
+
+func TestConnPoolPutReuse(t *testing.T) {
+	p := newConnPool(1, time.Minute)
+	server, client := net.Pipe()
+	defer server.Close()
+
+	p.put("tcp", "example:8080", client)
+
+	got, err := p.get("tcp", "example:8080", time.Second, nil)
+	if err != nil {
+		t.Fatalf("get() returned error: %v", err)
+	}
+	if got != client {
+		t.Fatalf("get() returned a different connection than was put back")
+	}
+}
+
+// TestPooledBodyCloseDrainsUnreadBytes verifies that closing a reusable pooledBody before
+// the caller has read the whole response body drains the remainder of the stream before the
+// connection goes back into the pool. Without that drain, the next request to reuse the
+// connection would start reading mid-body instead of at the start of the next response,
+// desyncing every request that follows on that connection.
+func TestPooledBodyCloseDrainsUnreadBytes(t *testing.T) {
+	p := newConnPool(1, time.Minute)
+	server, client := net.Pipe()
+	defer server.Close()
+
+	const unread = "rest-of-body"
+	const nextResponse = "next-response-start"
+	go func() {
+		io.WriteString(server, unread)
+		io.WriteString(server, nextResponse)
+	}()
+
+	body := p.wrapBody("tcp", "example:8080", client, io.NopCloser(io.LimitReader(client, int64(len(unread)))), true)
+
+	// Simulate a caller that gives up partway through the body instead of reading it fully.
+	buf := make([]byte, 4)
+	if _, err := body.Read(buf); err != nil {
+		t.Fatalf("Read() returned error: %v", err)
+	}
+	if err := body.Close(); err != nil {
+		t.Fatalf("Close() returned error: %v", err)
+	}
+
+	reused, err := p.get("tcp", "example:8080", time.Second, nil)
+	if err != nil {
+		t.Fatalf("get() returned error: %v", err)
+	}
+
+	got := make([]byte, len(nextResponse))
+	if _, err := io.ReadFull(reused, got); err != nil {
+		t.Fatalf("reading next response after reuse: %v", err)
+	}
+	if string(got) != nextResponse {
+		t.Fatalf("next response desynced: got %q, want %q", got, nextResponse)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2024 BadAimWeeb
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uwsgi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// responseType names the supported ways of interpreting bytes coming back from the uWSGI
+// backend, matching what its modifier1 codes can produce.
+const (
+	// responseTypeHTTP expects a full HTTP/1.x response, status line included. This is what
+	// modifier1 0 (WSGI) backends normally emit.
+	responseTypeHTTP = "http"
+
+	// responseTypeCGI expects CGI-style output: headers only (an optional "Status:" header in
+	// place of a status line), no HTTP status line. This is what modifier1 9 backends emit.
+	responseTypeCGI = "cgi"
+
+	// responseTypeRaw treats everything after the request as the response body verbatim, with
+	// no headers or status line at all. This is what modifier1 17 (raw response) backends emit.
+	responseTypeRaw = "raw"
+)
+
+func isValidResponseType(responseType string) bool {
+	switch responseType {
+	case "", responseTypeHTTP, responseTypeCGI, responseTypeRaw:
+		return true
+	default:
+		return false
+	}
+}
+
+// readResponse parses the uWSGI backend's reply from br according to responseType. The returned
+// bool reports whether the response body is bounded by a known length (so the underlying
+// connection can be drained and reused once the body is fully read) as opposed to being
+// terminated only by the backend closing the connection.
+func readResponse(responseType string, req *http.Request, br *bufio.Reader) (*http.Response, bool, error) {
+	switch responseType {
+	case "", responseTypeHTTP:
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, false, err
+		}
+		bounded := !resp.Close && (resp.ContentLength >= 0 || len(resp.TransferEncoding) > 0)
+		return resp, bounded, nil
+	case responseTypeCGI:
+		return readCGIResponse(req, br)
+	case responseTypeRaw:
+		return readRawResponse(req, br), false, nil
+	default:
+		return nil, false, fmt.Errorf("unsupported response_type %q", responseType)
+	}
+}
+
+// readCGIResponse builds an http.Response from a CGI-style reply: MIME headers terminated by a
+// blank line, with an optional "Status:" header standing in for the HTTP status line. This
+// mirrors how the fastcgi transport's buildResponse handles PHP's CGI-style output. The
+// connection can only be reused afterwards if Content-Length bounds the body; otherwise the rest
+// of the stream belongs to this response and there's no way to tell where it ends.
+func readCGIResponse(req *http.Request, br *bufio.Reader) (*http.Response, bool, error) {
+	mimeHeader, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, false, fmt.Errorf("reading CGI headers: %v", err)
+	}
+
+	resp := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header:     http.Header(mimeHeader),
+	}
+
+	if status := resp.Header.Get("Status"); status != "" {
+		resp.Header.Del("Status")
+		code, text, _ := strings.Cut(status, " ")
+		codeNum, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, false, fmt.Errorf("parsing Status header %q: %v", status, err)
+		}
+		resp.StatusCode = codeNum
+		if text != "" {
+			resp.Status = status
+		} else {
+			resp.Status = fmt.Sprintf("%d %s", codeNum, http.StatusText(codeNum))
+		}
+	} else {
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+	}
+
+	resp.ContentLength = -1
+	bounded := false
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			resp.ContentLength = n
+			bounded = true
+		}
+	}
+
+	if bounded {
+		resp.Body = io.NopCloser(io.LimitReader(br, resp.ContentLength))
+	} else {
+		resp.Body = io.NopCloser(br)
+	}
+	return resp, bounded, nil
+}
+
+// readRawResponse treats the rest of br as the response body verbatim, with no framing of any
+// kind, which is what a modifier1 17 (raw response) backend sends. There's no length signal at
+// all, so the connection can never be reused afterwards.
+func readRawResponse(req *http.Request, br *bufio.Reader) *http.Response {
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Header:        make(http.Header),
+		ContentLength: -1,
+		Body:          io.NopCloser(br),
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2024 BadAimWeeb
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uwsgi
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestReadCGIResponseBoundsBodyByContentLength verifies that reading the response body stops at
+// Content-Length and doesn't pull in bytes belonging to whatever follows on the wire (e.g. the
+// next pooled response).
+func TestReadCGIResponseBoundsBodyByContentLength(t *testing.T) {
+	raw := "Content-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello" + "NEXT RESPONSE ON THE WIRE"
+	br := bufio.NewReader(strings.NewReader(raw))
+
+	resp, bounded, err := readCGIResponse(&http.Request{}, br)
+	if err != nil {
+		t.Fatalf("readCGIResponse returned error: %v", err)
+	}
+	if !bounded {
+		t.Fatal("expected bounded=true when Content-Length is present")
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("body = %q, want %q (leaked into the next response)", body, "hello")
+	}
+}
+
+func TestReadCGIResponseWithoutContentLengthIsUnbounded(t *testing.T) {
+	raw := "Content-Type: text/plain\r\n\r\nhello"
+	br := bufio.NewReader(strings.NewReader(raw))
+
+	_, bounded, err := readCGIResponse(&http.Request{}, br)
+	if err != nil {
+		t.Fatalf("readCGIResponse returned error: %v", err)
+	}
+	if bounded {
+		t.Fatal("expected bounded=false without a Content-Length header")
+	}
+}
+
+// TestReadResponseHTTPWithoutLengthIsUnbounded verifies that an HTTP-mode response with neither
+// a Content-Length nor chunked Transfer-Encoding (e.g. an SSE or long-poll reply, terminated only
+// by the backend closing the connection) comes back unbounded, so the caller won't try to drain
+// it to EOF before pooling a connection that's never going to produce one.
+func TestReadResponseHTTPWithoutLengthIsUnbounded(t *testing.T) {
+	raw := "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n\r\ndata: hello\n\n"
+	br := bufio.NewReader(strings.NewReader(raw))
+
+	_, bounded, err := readResponse(responseTypeHTTP, &http.Request{}, br)
+	if err != nil {
+		t.Fatalf("readResponse returned error: %v", err)
+	}
+	if bounded {
+		t.Fatal("expected bounded=false without Content-Length or chunked Transfer-Encoding")
+	}
+}
+
+func TestReadResponseRawIsNeverReusable(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("hello"))
+	_, bounded, err := readResponse(responseTypeRaw, &http.Request{}, br)
+	if err != nil {
+		t.Fatalf("readResponse returned error: %v", err)
+	}
+	if bounded {
+		t.Fatal("raw responses should never report bounded=true")
+	}
+}
@@ -18,15 +18,20 @@ package uwsgi
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
 )
 
 func init() {
@@ -36,14 +41,45 @@ func init() {
 /*
 The uwsgi transport module allows you to proxy requests to an uWSGI server with uwsgi protocol.
 
+Upstreams may be TCP addresses, unix sockets (`unix//path/to/sock`), or Linux abstract sockets
+(`unix/@name`), same as reverse_proxy's own `to` addresses.
+
 Caddyfile syntax is supported:
 
 ```caddyfile
 
 	reverse_proxy [<matcher>] [<upstreams...>] {
 		transport uwsgi {
+			# talk to a uWSGI server bound with --https-socket
+			tls {
+				root_ca <file>
+				client_cert <cert_file> <key_file>
+				server_name <name>
+				insecure_skip_verify
+			}
+
 			# in case you need to set uwsgi params (for example UWSGI_SCRIPT), add this:
+			# values support Caddy placeholders, e.g. {http.request.uri.path}
 			uwsgi_param <key> <value>
+
+			# split the request URI into SCRIPT_NAME/PATH_INFO on the first matching suffix,
+			# useful for mounting a single app under a URL prefix
+			split_path <suffix...>
+
+			# connection pooling and timeouts
+			dial_timeout <duration>
+			read_timeout <duration>
+			write_timeout <duration>
+			max_conns <count>
+			idle_timeout <duration>
+
+			# talk to backends other than plain WSGI apps, e.g. RPC (5), CGI-style
+			# Perl PSGI/Rack (9), raw response apps (17), or the spooler (22)
+			modifier1 <n>
+			modifier2 <n>
+
+			# how to parse what the backend sends back; one of http (default), cgi, raw
+			response_type <http|cgi|raw>
 		}
 	}
 
@@ -53,6 +89,52 @@ type Transport struct {
 	// UWSGIParams is a map of static uwsgi params to be passed to uWSGI server.
 	// This is useful for example, setting UWSGI_SCRIPT (uWSGI may require this for some request) and many other params.
 	UWSGIParams map[string]string `json:"uwsgi_params,omitempty"`
+
+	// DialTimeout is the maximum time to wait for a new connection to the uWSGI server to be established.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	// ReadTimeout is the maximum time to wait to read the response from the uWSGI server.
+	ReadTimeout caddy.Duration `json:"read_timeout,omitempty"`
+
+	// WriteTimeout is the maximum time to wait to write the request to the uWSGI server.
+	WriteTimeout caddy.Duration `json:"write_timeout,omitempty"`
+
+	// MaxConns is the maximum number of idle connections to keep pooled per upstream. Defaults to 8.
+	MaxConns int `json:"max_conns,omitempty"`
+
+	// IdleTimeout is how long an idle pooled connection may sit before it is closed instead of reused.
+	// Defaults to 60s.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+
+	// SplitPath specifies a list of suffixes to split the request URI on, in order to identify
+	// SCRIPT_NAME and PATH_INFO. The first matching suffix (case-insensitive) determines the split
+	// point, everything up to and including it becomes SCRIPT_NAME, and the remainder becomes
+	// PATH_INFO. This is useful for mounting a single uWSGI app under a URL prefix. If empty
+	// (the default), SCRIPT_NAME is empty and PATH_INFO is the whole request path.
+	SplitPath []string `json:"split_path,omitempty"`
+
+	// TLS enables encrypted connections to the uWSGI backend, for servers bound with
+	// --https-socket. If nil, plain TCP/unix sockets are used.
+	TLS *reverseproxy.TLSConfig `json:"tls,omitempty"`
+
+	// Modifier1 is the uwsgi packet's modifier1 byte, selecting how the backend should
+	// interpret the request. Defaults to 0 (WSGI). Other common values are 5 (RPC),
+	// 9 (CGI-style Perl PSGI/Rack), 17 (raw response apps), and 100 (ping).
+	Modifier1 uint8 `json:"modifier1,omitempty"`
+
+	// Modifier2 is the uwsgi packet's modifier2 byte, refining Modifier1 for backends that use
+	// it (e.g. selecting a spooler command). Defaults to 0.
+	Modifier2 uint8 `json:"modifier2,omitempty"`
+
+	// ResponseType selects how the backend's reply is parsed: "http" (default) expects a full
+	// HTTP/1.x response with a status line; "cgi" expects CGI-style headers with an optional
+	// "Status:" header instead of a status line; "raw" treats the entire reply as the response
+	// body with no framing at all.
+	ResponseType string `json:"response_type,omitempty"`
+
+	pool      *connPool
+	logger    *zap.Logger
+	tlsConfig *tls.Config
 }
 
 // CaddyModule returns the Caddy module information.
@@ -67,6 +149,41 @@ func (Transport) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision sets up the transport, initializing its logger and connection pool.
+func (t *Transport) Provision(ctx caddy.Context) error {
+	t.logger = ctx.Logger()
+
+	if t.MaxConns <= 0 {
+		t.MaxConns = 8
+	}
+	if t.IdleTimeout == 0 {
+		t.IdleTimeout = caddy.Duration(60 * time.Second)
+	}
+	if t.TLS != nil {
+		tlsConfig, err := t.TLS.MakeTLSClientConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("making TLS client config: %v", err)
+		}
+		t.tlsConfig = tlsConfig
+	}
+
+	if !isValidResponseType(t.ResponseType) {
+		return fmt.Errorf("unsupported response_type %q", t.ResponseType)
+	}
+
+	t.pool = newConnPool(t.MaxConns, time.Duration(t.IdleTimeout))
+
+	return nil
+}
+
+// Cleanup closes all pooled connections and releases resources held by the transport.
+func (t *Transport) Cleanup() error {
+	if t.pool != nil {
+		t.pool.closeAll()
+	}
+	return nil
+}
+
 var headerNameReplacer = strings.NewReplacer("-", "_")
 
 func writeBlockVar(buffer *bytes.Buffer, s string) {
@@ -75,6 +192,26 @@ func writeBlockVar(buffer *bytes.Buffer, s string) {
 	buffer.Write(b)
 }
 
+// splitScriptPath splits path into SCRIPT_NAME and PATH_INFO according to splitPath, a list of
+// suffixes to split on (matched case-insensitively), the same way the fastcgi transport does. The
+// first suffix found in path determines the split point; everything up to and including it becomes
+// SCRIPT_NAME. If none match, or splitPath is empty, SCRIPT_NAME is empty and PATH_INFO is path.
+func splitScriptPath(path string, splitPath []string) (scriptName, pathInfo string) {
+	if len(splitPath) == 0 {
+		return "", path
+	}
+
+	lowerPath := strings.ToLower(path)
+	for _, split := range splitPath {
+		if idx := strings.Index(lowerPath, strings.ToLower(split)); idx > -1 {
+			splitPos := idx + len(split)
+			return path[:splitPos], path[splitPos:]
+		}
+	}
+
+	return "", path
+}
+
 // generateBlockVars returns the packet body of WSGI block vars generated from http.Request.
 func generateBlockVars(req *http.Request, t Transport) (*bytes.Buffer, error) {
 	serverName, serverPort, err := net.SplitHostPort(req.Host)
@@ -102,6 +239,8 @@ func generateBlockVars(req *http.Request, t Transport) (*bytes.Buffer, error) {
 		remoteAddr = remoteAddr[1 : len(remoteAddr)-1]
 	}
 
+	scriptName, pathInfo := splitScriptPath(req.URL.Path, t.SplitPath)
+
 	vars := map[string]string{
 		"QUERY_STRING":   req.URL.RawQuery,
 		"REQUEST_METHOD": req.Method,
@@ -109,7 +248,8 @@ func generateBlockVars(req *http.Request, t Transport) (*bytes.Buffer, error) {
 		"CONTENT_LENGTH": req.Header.Get("Content-Length"),
 
 		"REQUEST_URI":     req.RequestURI,
-		"PATH_INFO":       req.URL.Path,
+		"SCRIPT_NAME":     scriptName,
+		"PATH_INFO":       pathInfo,
 		"SERVER_PROTOCOL": req.Proto,
 		"REQUEST_SCHEME":  req.URL.Scheme,
 		"HTTPS":           httpsConn,
@@ -130,8 +270,12 @@ func generateBlockVars(req *http.Request, t Transport) (*bytes.Buffer, error) {
 		vars["HTTP_"+headerNameReplacer.Replace(strings.ToUpper(name))] = strings.Join(value, ", ")
 	}
 
+	repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
 	for name, value := range t.UWSGIParams {
-		vars[name] = value
+		vars[name] = repl.ReplaceAll(value, "")
 	}
 
 	var packetBody bytes.Buffer
@@ -149,50 +293,199 @@ func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		network = dialInfo.Network
 		address = dialInfo.Address
 	}
-	conn, err := net.Dial(network, address)
+
+	conn, err := t.pool.get(network, address, time.Duration(t.DialTimeout), t.tlsConfig)
 	if err != nil {
 		return nil, err
 	}
 
 	blockVars, err := generateBlockVars(req, t)
 	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if t.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(time.Duration(t.WriteTimeout)))
+	}
+
+	if err := writeVarsPacket(conn, t.Modifier1, t.Modifier2, blockVars); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	conn.Write([]byte{0})                                            // modifier1
-	binary.Write(conn, binary.LittleEndian, uint16(blockVars.Len())) // datasize
-	conn.Write([]byte{0})                                            // modifier2
-	io.Copy(conn, blockVars)                                         // packet body
+	// if the body's length isn't known up front (e.g. chunked request bodies), uWSGI has no
+	// way to tell where it ends unless we half-close the write side; that means the connection
+	// can't be reused afterwards, since it can never be written to again.
+	needsHalfClose := req.Body != nil && req.ContentLength < 0
 
 	if req.Body != nil {
 		io.Copy(conn, req.Body)
 		req.Body.Close()
 	}
 
-	return http.ReadResponse(bufio.NewReader(conn), req)
+	if needsHalfClose {
+		if err := halfCloseWrite(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if t.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(t.ReadTimeout)))
+	}
+
+	// bufio.NewReaderSize only buffers what a single Read off the wire returns; resp.Body reads
+	// lazily through it as the caller consumes it, so response streaming (SSE, chunked, long
+	// polling) isn't defeated by parsing the status line and headers up front.
+	resp, bodyBounded, err := readResponse(t.ResponseType, req, bufio.NewReaderSize(conn, 4096))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp.Body = t.pool.wrapBody(network, address, conn, resp.Body, !needsHalfClose && bodyBounded)
+
+	return resp, nil
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
 func (t *Transport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			if err := t.unmarshalSubdirective(d); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// unmarshalSubdirective applies a single transport subdirective, with the dispenser positioned
+// on it. It's shared by UnmarshalCaddyfile and the "uwsgi" shortcut directive so the two accept
+// exactly the same options.
+func (t *Transport) unmarshalSubdirective(d *caddyfile.Dispenser) error {
+	switch d.Val() {
+	case "uwsgi_param":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		key := d.Val()
+
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		value := d.Val()
+
+		t.UWSGIParams[key] = value
+	case "split_path":
+		t.SplitPath = d.RemainingArgs()
+		if len(t.SplitPath) == 0 {
+			return d.ArgErr()
+		}
+	case "dial_timeout":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("parsing dial_timeout duration: %v", err)
+		}
+		t.DialTimeout = caddy.Duration(dur)
+	case "read_timeout":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("parsing read_timeout duration: %v", err)
+		}
+		t.ReadTimeout = caddy.Duration(dur)
+	case "write_timeout":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("parsing write_timeout duration: %v", err)
+		}
+		t.WriteTimeout = caddy.Duration(dur)
+	case "max_conns":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("parsing max_conns: %v", err)
+		}
+		t.MaxConns = n
+	case "idle_timeout":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("parsing idle_timeout duration: %v", err)
+		}
+		t.IdleTimeout = caddy.Duration(dur)
+	case "tls":
+		tlsConfig := &reverseproxy.TLSConfig{}
 		for nesting := d.Nesting(); d.NextBlock(nesting); {
 			switch d.Val() {
-			case "uwsgi_param":
+			case "root_ca":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				key := d.Val()
-
+				tlsConfig.RootCAPEMFiles = append(tlsConfig.RootCAPEMFiles, d.Val())
+			case "client_cert":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				tlsConfig.ClientCertificateFile = args[0]
+				tlsConfig.ClientCertificateKeyFile = args[1]
+			case "server_name":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				value := d.Val()
-
-				t.UWSGIParams[key] = value
+				tlsConfig.ServerName = d.Val()
+			case "insecure_skip_verify":
+				tlsConfig.InsecureSkipVerify = true
 			default:
-				return d.Errf("unknown subdirective %s", d.Val())
+				return d.Errf("unknown tls subdirective %s", d.Val())
 			}
 		}
+		t.TLS = tlsConfig
+	case "modifier1":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.ParseUint(d.Val(), 10, 8)
+		if err != nil {
+			return d.Errf("parsing modifier1: %v", err)
+		}
+		t.Modifier1 = uint8(n)
+	case "modifier2":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.ParseUint(d.Val(), 10, 8)
+		if err != nil {
+			return d.Errf("parsing modifier2: %v", err)
+		}
+		t.Modifier2 = uint8(n)
+	case "response_type":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		responseType := d.Val()
+		if !isValidResponseType(responseType) {
+			return d.Errf("unsupported response_type %q, expected http, cgi, or raw", responseType)
+		}
+		t.ResponseType = responseType
+	default:
+		return d.Errf("unknown subdirective %s", d.Val())
 	}
 
 	return nil
@@ -201,4 +494,6 @@ func (t *Transport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 var (
 	_ http.RoundTripper     = (*Transport)(nil)
 	_ caddyfile.Unmarshaler = (*Transport)(nil)
+	_ caddy.Provisioner     = (*Transport)(nil)
+	_ caddy.CleanerUpper    = (*Transport)(nil)
 )